@@ -0,0 +1,330 @@
+// Package containerd implements oci.OCIClient backed by a containerd
+// content store. It registers itself under the name "containerd" so
+// main.go can select it with --oci-backend through a blank import, without
+// referring to this package's identifiers.
+package containerd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd"
+	eventtypes "github.com/containerd/containerd/api/events"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/leases"
+	"github.com/containerd/typeurl/v2"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/xenitab/spegel/internal/oci"
+)
+
+func init() {
+	oci.Register("containerd", New)
+}
+
+// leaseTTL is the expiration set on each lease acquired by WithLease. It is
+// also a backstop against a release func that never runs, for example when a
+// client disconnects mid-response; the content store's regular GC pass will
+// not touch leased resources until this expires. A single response can
+// easily outlast it though (a large blob over a slow peer-to-peer link, for
+// example), so WithLease does not rely on one lease surviving the whole
+// call: see leaseRenewInterval.
+const leaseTTL = 2 * time.Minute
+
+// leaseRenewInterval is how often WithLease swaps in a freshly expiring
+// lease for the one it is currently holding, so a caller that holds the
+// release func open longer than leaseTTL stays protected for as long as it
+// needs rather than having the lease expire out from under it.
+const leaseRenewInterval = leaseTTL / 2
+
+// Client implements oci.OCIClient backed by a containerd content store.
+type Client struct {
+	client *containerd.Client
+}
+
+// New connects to the containerd socket and namespace given in cfg. It is
+// registered with oci.Register under the name "containerd".
+func New(ctx context.Context, cfg oci.Config) (oci.OCIClient, error) {
+	client, err := containerd.New(cfg.ContainerdSock, containerd.WithDefaultNamespace(cfg.ContainerdNamespace))
+	if err != nil {
+		return nil, fmt.Errorf("could not create containerd client: %w", err)
+	}
+	return &Client{client: client}, nil
+}
+
+func (c *Client) Name() string {
+	return "containerd"
+}
+
+func (c *Client) Close() error {
+	return c.client.Close()
+}
+
+func (c *Client) GetContent(ctx context.Context, dgst digest.Digest) ([]byte, string, error) {
+	store := c.client.ContentStore()
+	info, err := store.Info(ctx, dgst)
+	if err != nil {
+		return nil, "", fmt.Errorf("could not get content info for digest %s: %w", dgst, err)
+	}
+	b, err := content.ReadBlob(ctx, store, ocispec.Descriptor{Digest: dgst, Size: info.Size})
+	if err != nil {
+		return nil, "", fmt.Errorf("could not read content for digest %s: %w", dgst, err)
+	}
+	// Containerd's content store does not track media type alongside the
+	// blob, so we read it back out of the manifest/index JSON itself.
+	var envelope struct {
+		MediaType string `json:"mediaType"`
+	}
+	if err := json.Unmarshal(b, &envelope); err != nil {
+		return nil, "", fmt.Errorf("could not determine media type for digest %s: %w", dgst, err)
+	}
+	return b, envelope.MediaType, nil
+}
+
+func (c *Client) GetSize(ctx context.Context, dgst digest.Digest) (int64, error) {
+	info, err := c.client.ContentStore().Info(ctx, dgst)
+	if err != nil {
+		return 0, fmt.Errorf("could not get content info for digest %s: %w", dgst, err)
+	}
+	return info.Size, nil
+}
+
+func (c *Client) Copy(ctx context.Context, dgst digest.Digest, dst io.Writer) error {
+	store := c.client.ContentStore()
+	ra, err := store.ReaderAt(ctx, ocispec.Descriptor{Digest: dgst})
+	if err != nil {
+		return fmt.Errorf("could not open reader for digest %s: %w", dgst, err)
+	}
+	defer ra.Close()
+	if _, err := io.Copy(dst, content.NewReader(ra)); err != nil {
+		return fmt.Errorf("could not copy content for digest %s: %w", dgst, err)
+	}
+	return nil
+}
+
+func (c *Client) CopyRange(ctx context.Context, dgst digest.Digest, off, n int64, dst io.Writer) error {
+	store := c.client.ContentStore()
+	ra, err := store.ReaderAt(ctx, ocispec.Descriptor{Digest: dgst})
+	if err != nil {
+		return fmt.Errorf("could not open reader for digest %s: %w", dgst, err)
+	}
+	defer ra.Close()
+	if _, err := io.Copy(dst, io.NewSectionReader(ra, off, n)); err != nil {
+		return fmt.Errorf("could not copy range [%d,%d) for digest %s: %w", off, off+n, dgst, err)
+	}
+	return nil
+}
+
+// WithLease acquires a containerd lease covering digests for the lifetime
+// of the returned release func, so a GC pass triggered by an in-flight
+// image removal cannot delete blobs while they are being copied to a peer.
+// The lease is periodically replaced with a fresh one in the background so
+// a response running longer than leaseTTL does not lose protection
+// partway through.
+func (c *Client) WithLease(ctx context.Context, digests ...digest.Digest) (context.Context, func() error, error) {
+	lm := c.client.LeasesService()
+	lease, err := createLease(ctx, lm, digests)
+	if err != nil {
+		return ctx, nil, err
+	}
+	leasedCtx := leases.WithLease(ctx, lease.ID)
+
+	renewCtx, stopRenew := context.WithCancel(context.Background())
+	var mu sync.Mutex
+	current := lease
+	go func() {
+		ticker := time.NewTicker(leaseRenewInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-renewCtx.Done():
+				return
+			case <-ticker.C:
+				next, err := createLease(context.Background(), lm, digests)
+				if err != nil {
+					// The existing lease is still valid for now; try again
+					// on the next tick rather than giving up on renewal.
+					continue
+				}
+				mu.Lock()
+				old := current
+				current = next
+				mu.Unlock()
+				//nolint:errcheck // best effort, a leftover lease just expires on its own
+				lm.Delete(context.Background(), old)
+			}
+		}
+	}()
+
+	release := func() error {
+		stopRenew()
+		mu.Lock()
+		lease := current
+		mu.Unlock()
+		return lm.Delete(context.Background(), lease)
+	}
+	return leasedCtx, release, nil
+}
+
+// createLease creates a new lease with a fresh leaseTTL expiration and adds
+// each of digests to it as a content resource.
+func createLease(ctx context.Context, lm leases.Manager, digests []digest.Digest) (leases.Lease, error) {
+	lease, err := lm.Create(ctx, leases.WithRandomID(), leases.WithExpiration(leaseTTL))
+	if err != nil {
+		return leases.Lease{}, fmt.Errorf("could not create lease: %w", err)
+	}
+	for _, dgst := range digests {
+		resource := leases.Resource{
+			ID:   dgst.String(),
+			Type: "content",
+		}
+		if err := lm.AddResource(ctx, lease, resource); err != nil {
+			//nolint:errcheck // best effort cleanup, the original error is what matters
+			lm.Delete(ctx, lease)
+			return leases.Lease{}, fmt.Errorf("could not add digest %s to lease: %w", dgst, err)
+		}
+	}
+	return lease, nil
+}
+
+func (c *Client) List(ctx context.Context) ([]oci.Image, error) {
+	imgs, err := c.client.ImageService().List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not list images: %w", err)
+	}
+	out := make([]oci.Image, 0, len(imgs))
+	for _, img := range imgs {
+		image, ok := parseImageName(img.Name)
+		if !ok {
+			continue
+		}
+		image.Digest = img.Target.Digest
+		out = append(out, image)
+	}
+	return out, nil
+}
+
+// Subscribe sends an EventTypeAll snapshot from List, then relays the
+// containerd image create/update/delete events for as long as ctx is
+// valid.
+func (c *Client) Subscribe(ctx context.Context) (<-chan oci.ImageEvent, error) {
+	imgs, err := c.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	envelopeCh, errCh := c.client.EventService().Subscribe(ctx,
+		`topic=="/images/create"`,
+		`topic=="/images/update"`,
+		`topic=="/images/delete"`,
+	)
+
+	out := make(chan oci.ImageEvent, 1)
+	go func() {
+		defer close(out)
+		for _, img := range imgs {
+			select {
+			case out <- oci.ImageEvent{Type: oci.EventTypeAll, Image: img}:
+			case <-ctx.Done():
+				return
+			}
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case err, ok := <-errCh:
+				if !ok || err != nil {
+					return
+				}
+			case env, ok := <-envelopeCh:
+				if !ok {
+					return
+				}
+				evt, ok := decodeImageEvent(ctx, c.client.ImageService(), env.Event)
+				if !ok {
+					continue
+				}
+				select {
+				case out <- evt:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return out, nil
+}
+
+// imageGetter is the subset of containerd's image service decodeImageEvent
+// needs to resolve a create/update event's current digest, declared
+// narrowly so tests can supply a fake instead of a full containerd client.
+type imageGetter interface {
+	Get(ctx context.Context, name string) (images.Image, error)
+}
+
+// decodeImageEvent unmarshals a containerd image event envelope into an
+// oci.ImageEvent, returning ok=false for anything that isn't a recognized
+// image create/update/delete or whose name doesn't parse. Unlike List, the
+// event envelope itself carries no digest, so a create/update event looks
+// its image back up through getter the same way List does; if the image is
+// already gone by the time we look (for example a create immediately
+// followed by a delete), the event is dropped rather than advertised with
+// no digest.
+func decodeImageEvent(ctx context.Context, getter imageGetter, any typeurl.Any) (oci.ImageEvent, bool) {
+	v, err := typeurl.UnmarshalAny(any)
+	if err != nil {
+		return oci.ImageEvent{}, false
+	}
+	var name string
+	eventType := oci.EventTypeAdd
+	switch e := v.(type) {
+	case *eventtypes.ImageCreate:
+		name = e.Name
+	case *eventtypes.ImageUpdate:
+		name = e.Name
+	case *eventtypes.ImageDelete:
+		name = e.Name
+		eventType = oci.EventTypeDelete
+	default:
+		return oci.ImageEvent{}, false
+	}
+	image, ok := parseImageName(name)
+	if !ok {
+		return oci.ImageEvent{}, false
+	}
+	if eventType != oci.EventTypeDelete {
+		img, err := getter.Get(ctx, name)
+		if err != nil {
+			return oci.ImageEvent{}, false
+		}
+		image.Digest = img.Target.Digest
+	}
+	return oci.ImageEvent{Type: eventType, Image: image}, true
+}
+
+// parseImageName splits a containerd image name such as
+// "docker.io/library/alpine:latest" into its registry, repository, and tag.
+// It returns ok=false for names that aren't tagged references, for example
+// ones already pinned to a digest.
+func parseImageName(name string) (oci.Image, bool) {
+	registry, rest, ok := strings.Cut(name, "/")
+	if !ok {
+		return oci.Image{}, false
+	}
+	repository, tag, ok := strings.Cut(rest, ":")
+	if !ok {
+		return oci.Image{}, false
+	}
+	return oci.Image{
+		Registry:   registry,
+		Repository: repository,
+		Tag:        tag,
+	}, true
+}
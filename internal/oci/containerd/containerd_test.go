@@ -0,0 +1,107 @@
+package containerd
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	eventtypes "github.com/containerd/containerd/api/events"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/typeurl/v2"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/xenitab/spegel/internal/oci"
+)
+
+type fakeImageGetter struct {
+	images map[string]images.Image
+}
+
+func (f *fakeImageGetter) Get(_ context.Context, name string) (images.Image, error) {
+	img, ok := f.images[name]
+	if !ok {
+		return images.Image{}, fmt.Errorf("image %s not found", name)
+	}
+	return img, nil
+}
+
+func mustMarshalAny(t *testing.T, v interface{}) typeurl.Any {
+	t.Helper()
+	any, err := typeurl.MarshalAny(v)
+	if err != nil {
+		t.Fatalf("could not marshal %T: %v", v, err)
+	}
+	return any
+}
+
+func TestDecodeImageEvent(t *testing.T) {
+	const name = "docker.io/library/alpine:latest"
+	dgst := digest.FromString("alpine")
+	getter := &fakeImageGetter{
+		images: map[string]images.Image{
+			name: {Name: name, Target: ocispec.Descriptor{Digest: dgst}},
+		},
+	}
+
+	cases := []struct {
+		name       string
+		event      interface{}
+		wantOK     bool
+		wantType   oci.EventType
+		wantDigest digest.Digest
+	}{
+		{
+			name:       "create resolves digest from the image service",
+			event:      &eventtypes.ImageCreate{Name: name},
+			wantOK:     true,
+			wantType:   oci.EventTypeAdd,
+			wantDigest: dgst,
+		},
+		{
+			name:       "update resolves digest from the image service",
+			event:      &eventtypes.ImageUpdate{Name: name},
+			wantOK:     true,
+			wantType:   oci.EventTypeAdd,
+			wantDigest: dgst,
+		},
+		{
+			name:     "delete does not need a digest",
+			event:    &eventtypes.ImageDelete{Name: name},
+			wantOK:   true,
+			wantType: oci.EventTypeDelete,
+		},
+		{
+			name:   "create for an image the getter doesn't know is dropped",
+			event:  &eventtypes.ImageCreate{Name: "docker.io/library/missing:latest"},
+			wantOK: false,
+		},
+		{
+			name:   "create with an unparseable name is dropped",
+			event:  &eventtypes.ImageCreate{Name: "not-a-valid-reference"},
+			wantOK: false,
+		},
+		{
+			name:   "unrecognized event type is dropped",
+			event:  &eventtypes.ContentDelete{Digest: dgst.String()},
+			wantOK: false,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			evt, ok := decodeImageEvent(context.Background(), getter, mustMarshalAny(t, tc.event))
+			if ok != tc.wantOK {
+				t.Fatalf("decodeImageEvent() ok = %v, want %v", ok, tc.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if evt.Type != tc.wantType {
+				t.Errorf("decodeImageEvent() type = %v, want %v", evt.Type, tc.wantType)
+			}
+			if tc.wantType != oci.EventTypeDelete && evt.Image.Digest != tc.wantDigest {
+				t.Errorf("decodeImageEvent() digest = %q, want %q", evt.Image.Digest, tc.wantDigest)
+			}
+		})
+	}
+}
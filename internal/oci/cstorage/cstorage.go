@@ -0,0 +1,273 @@
+// Package cstorage implements oci.OCIClient backed by a containers/storage
+// store, the local image store CRI-O and Podman manage directly without
+// going through containerd. It registers itself under the name "cri-o" so
+// main.go can select it with --oci-backend.
+package cstorage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	cstorage "github.com/containers/storage"
+	"github.com/opencontainers/go-digest"
+
+	"github.com/xenitab/spegel/internal/oci"
+)
+
+func init() {
+	oci.Register("cri-o", New)
+}
+
+// pollInterval is how often Subscribe re-lists the store to discover image
+// changes. Unlike containerd's event service, containers/storage has no
+// native change-notification API, so polling is the only option.
+const pollInterval = 5 * time.Second
+
+// Client implements oci.OCIClient backed by a containers/storage store.
+type Client struct {
+	store cstorage.Store
+}
+
+// New opens the containers/storage store rooted at cfg.CriOStorageRoot
+// using cfg.CriOStorageDriver. It is registered with oci.Register under
+// the name "cri-o".
+func New(ctx context.Context, cfg oci.Config) (oci.OCIClient, error) {
+	store, err := cstorage.GetStore(cstorage.StoreOptions{
+		GraphRoot:       cfg.CriOStorageRoot,
+		GraphDriverName: cfg.CriOStorageDriver,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not open containers/storage store at %s: %w", cfg.CriOStorageRoot, err)
+	}
+	return &Client{store: store}, nil
+}
+
+func (c *Client) Name() string {
+	return "cri-o"
+}
+
+func (c *Client) Close() error {
+	_, err := c.store.Shutdown(false)
+	return err
+}
+
+// imageBigData looks up dgst across every image's big data, the convention
+// containers/image's storage transport uses to keep a manifest and its
+// config blob retrievable by digest alongside the image that references
+// them. It only ever finds manifests and configs, never layers.
+func (c *Client) imageBigData(dgst digest.Digest) ([]byte, error) {
+	images, err := c.store.Images()
+	if err != nil {
+		return nil, fmt.Errorf("could not list images: %w", err)
+	}
+	for _, img := range images {
+		b, err := c.store.ImageBigData(img.ID, dgst.String())
+		if err == nil {
+			return b, nil
+		}
+	}
+	return nil, fmt.Errorf("no image big data found for digest %s", dgst)
+}
+
+// layerBigData looks up dgst among the store's layers. containers/image's
+// storage transport caches the original (often compressed) layer blob as
+// layer big data keyed by its own digest whenever it writes or reuses a
+// layer, specifically so the blob can be read back out later without
+// recompressing the on-disk diff; this is what lets a layer survive being
+// re-exported by e.g. "skopeo copy" and is what we rely on here to serve it
+// to a peer. A layer pulled by some other path that never populated that
+// big data (rather than missing from the store) is the one case this
+// cannot recover from.
+func (c *Client) layerBigData(dgst digest.Digest) ([]byte, error) {
+	layers, err := c.store.Layers()
+	if err != nil {
+		return nil, fmt.Errorf("could not list layers: %w", err)
+	}
+	for _, layer := range layers {
+		if layer.CompressedDigest != dgst && layer.UncompressedDigest != dgst {
+			continue
+		}
+		b, err := c.store.LayerBigData(layer.ID, dgst.String())
+		if err == nil {
+			return b, nil
+		}
+	}
+	return nil, fmt.Errorf("no layer big data found for digest %s", dgst)
+}
+
+// content returns the bytes stored under dgst, checking image big data
+// (manifests, configs) and then layer big data (layers) in turn.
+func (c *Client) content(dgst digest.Digest) ([]byte, error) {
+	if b, err := c.imageBigData(dgst); err == nil {
+		return b, nil
+	}
+	b, err := c.layerBigData(dgst)
+	if err != nil {
+		return nil, fmt.Errorf("could not find content for digest %s: %w", dgst, err)
+	}
+	return b, nil
+}
+
+// GetContent only ever looks at image big data: a manifest or index is
+// never stored as a layer, so there is no need to pay for layerBigData's
+// Layers() scan here.
+func (c *Client) GetContent(ctx context.Context, dgst digest.Digest) ([]byte, string, error) {
+	b, err := c.imageBigData(dgst)
+	if err != nil {
+		return nil, "", err
+	}
+	var envelope struct {
+		MediaType string `json:"mediaType"`
+	}
+	if err := json.Unmarshal(b, &envelope); err != nil {
+		return nil, "", fmt.Errorf("could not determine media type for digest %s: %w", dgst, err)
+	}
+	return b, envelope.MediaType, nil
+}
+
+func (c *Client) GetSize(ctx context.Context, dgst digest.Digest) (int64, error) {
+	b, err := c.content(dgst)
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(b)), nil
+}
+
+func (c *Client) Copy(ctx context.Context, dgst digest.Digest, dst io.Writer) error {
+	b, err := c.content(dgst)
+	if err != nil {
+		return err
+	}
+	if _, err := dst.Write(b); err != nil {
+		return fmt.Errorf("could not copy content for digest %s: %w", dgst, err)
+	}
+	return nil
+}
+
+func (c *Client) CopyRange(ctx context.Context, dgst digest.Digest, off, n int64, dst io.Writer) error {
+	b, err := c.content(dgst)
+	if err != nil {
+		return err
+	}
+	if off < 0 || n < 0 || off+n > int64(len(b)) {
+		return fmt.Errorf("range [%d,%d) out of bounds for digest %s of size %d", off, off+n, dgst, len(b))
+	}
+	if _, err := dst.Write(b[off : off+n]); err != nil {
+		return fmt.Errorf("could not copy range [%d,%d) for digest %s: %w", off, off+n, dgst, err)
+	}
+	return nil
+}
+
+// WithLease is a no-op: containers/storage has no garbage collector running
+// concurrently with image removal the way containerd does, so there is
+// nothing to protect against.
+func (c *Client) WithLease(ctx context.Context, digests ...digest.Digest) (context.Context, func() error, error) {
+	return ctx, func() error { return nil }, nil
+}
+
+func (c *Client) List(ctx context.Context) ([]oci.Image, error) {
+	images, err := c.store.Images()
+	if err != nil {
+		return nil, fmt.Errorf("could not list images: %w", err)
+	}
+	return c.toOCIImages(images), nil
+}
+
+func (c *Client) toOCIImages(images []cstorage.Image) []oci.Image {
+	out := make([]oci.Image, 0, len(images))
+	for _, img := range images {
+		for _, name := range img.Names {
+			image, ok := parseImageName(name)
+			if !ok {
+				continue
+			}
+			image.Digest = digest.Digest(img.Digest)
+			out = append(out, image)
+		}
+	}
+	return out
+}
+
+// Subscribe sends an EventTypeAll snapshot from List, then polls the store
+// every pollInterval and diffs the result against what it last reported to
+// synthesize Add/Delete events.
+func (c *Client) Subscribe(ctx context.Context) (<-chan oci.ImageEvent, error) {
+	imgs, err := c.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan oci.ImageEvent, 1)
+	go func() {
+		defer close(out)
+		seen := map[oci.Image]bool{}
+		for _, img := range imgs {
+			select {
+			case out <- oci.ImageEvent{Type: oci.EventTypeAll, Image: img}:
+			case <-ctx.Done():
+				return
+			}
+			seen[img] = true
+		}
+
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				images, err := c.store.Images()
+				if err != nil {
+					continue
+				}
+				current := map[oci.Image]bool{}
+				for _, img := range c.toOCIImages(images) {
+					current[img] = true
+					if !seen[img] {
+						select {
+						case out <- oci.ImageEvent{Type: oci.EventTypeAdd, Image: img}:
+						case <-ctx.Done():
+							return
+						}
+					}
+				}
+				for img := range seen {
+					if !current[img] {
+						select {
+						case out <- oci.ImageEvent{Type: oci.EventTypeDelete, Image: img}:
+						case <-ctx.Done():
+							return
+						}
+					}
+				}
+				seen = current
+			}
+		}
+	}()
+	return out, nil
+}
+
+// parseImageName splits a containers/storage image name such as
+// "docker.io/library/alpine:latest" into its registry, repository, and tag.
+// It returns ok=false for names that aren't tagged references, for example
+// ones already pinned to a digest.
+func parseImageName(name string) (oci.Image, bool) {
+	registry, rest, ok := strings.Cut(name, "/")
+	if !ok {
+		return oci.Image{}, false
+	}
+	repository, tag, ok := strings.Cut(rest, ":")
+	if !ok {
+		return oci.Image{}, false
+	}
+	return oci.Image{
+		Registry:   registry,
+		Repository: repository,
+		Tag:        tag,
+	}, true
+}
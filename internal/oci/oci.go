@@ -0,0 +1,145 @@
+// Package oci abstracts the container runtime content store that Spegel
+// reads images from and serves to peers. Concrete backends (containerd,
+// CRI-O/Podman's containers/storage) live in subpackages and register
+// themselves with Register so registryCommand can select one by name at
+// runtime instead of this package depending on every backend's client
+// library directly.
+package oci
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Image identifies one image tracked by a backend, as returned by List and
+// carried on ImageEvent.
+type Image struct {
+	// Registry and Repository are parsed from the image name as stored by
+	// the backend, for example "docker.io" and "library/alpine".
+	Registry   string
+	Repository string
+	Tag        string
+	Digest     digest.Digest
+}
+
+// EventType distinguishes the kinds of change a backend can report on its
+// Subscribe channel.
+type EventType int
+
+const (
+	// EventTypeAll marks one image in the initial snapshot Subscribe sends
+	// before it starts streaming incremental events, so a caller never has
+	// to race List against the first few events.
+	EventTypeAll EventType = iota
+	EventTypeAdd
+	EventTypeDelete
+)
+
+// ImageEvent is one entry in the backend-agnostic event stream consumed by
+// state.Track, so the advertisement loop does not care whether the image
+// came from containerd, CRI-O, or Podman.
+type ImageEvent struct {
+	Type  EventType
+	Image Image
+}
+
+// OCIClient gives the registry handler and state tracker backend-agnostic
+// access to locally stored OCI content.
+type OCIClient interface {
+	// Name identifies the backend implementation, for example "containerd"
+	// or "cri-o". It is used as a metric label and in log messages.
+	Name() string
+	// Close releases the backend's underlying connection or store handle.
+	Close() error
+	// GetContent returns the raw bytes and media type of the manifest or
+	// index stored under dgst.
+	GetContent(ctx context.Context, dgst digest.Digest) ([]byte, string, error)
+	// GetSize returns the size in bytes of the content stored under dgst.
+	GetSize(ctx context.Context, dgst digest.Digest) (int64, error)
+	// Copy writes the full content stored under dgst to dst.
+	Copy(ctx context.Context, dgst digest.Digest, dst io.Writer) error
+	// CopyRange writes n bytes starting at offset off of the content stored
+	// under dgst to dst. It is used to serve Range requests so peers can
+	// fetch pieces of a large blob in parallel.
+	CopyRange(ctx context.Context, dgst digest.Digest, off, n int64, dst io.Writer) error
+	// WithLease acquires a lease that keeps digests (and, transitively, any
+	// content they reference) from being garbage collected for as long as
+	// the returned context is in use. The returned release func must be
+	// called to release the lease once the caller is done reading. On
+	// backends without garbage collection leases are a no-op: the returned
+	// context is ctx unchanged and release always returns nil.
+	WithLease(ctx context.Context, digests ...digest.Digest) (context.Context, func() error, error)
+	// List returns every image currently known to the backend, matching
+	// what the most recent EventTypeAll event on Subscribe reported.
+	List(ctx context.Context) ([]Image, error)
+	// Subscribe streams image add/delete events until ctx is cancelled or
+	// the returned channel is closed, starting with one EventTypeAll event
+	// for each image in the current image set.
+	Subscribe(ctx context.Context) (<-chan ImageEvent, error)
+}
+
+// Config carries every backend-specific setting registryCommand accepts as
+// flags. A Factory reads only the fields its backend needs.
+type Config struct {
+	// ContainerdSock and ContainerdNamespace configure the containerd
+	// backend.
+	ContainerdSock      string
+	ContainerdNamespace string
+	// CriOStorageRoot and CriOStorageDriver configure the cri-o backend,
+	// matching the graph root and driver CRI-O (or Podman) was configured
+	// with, since both read the same containers/storage state.
+	CriOStorageRoot   string
+	CriOStorageDriver string
+}
+
+// Factory creates an OCIClient from cfg. Backends register one under their
+// name via Register, typically from an init func in the backend package.
+type Factory func(ctx context.Context, cfg Config) (OCIClient, error)
+
+var (
+	mu        sync.Mutex
+	factories = map[string]Factory{}
+
+	backendGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "spegel_oci_backend_info",
+			Help: "Label-only metric identifying the configured OCI backend; value is always 1.",
+		},
+		[]string{"backend"},
+	)
+)
+
+// Register associates name, as selected by the --oci-backend flag, with
+// factory. It panics on a duplicate name, which can only happen from a
+// programming error since each backend package registers itself once.
+func Register(name string, factory Factory) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := factories[name]; ok {
+		panic(fmt.Sprintf("oci: backend %q already registered", name))
+	}
+	factories[name] = factory
+}
+
+// New creates the OCIClient registered under name, returning an error if no
+// backend has registered itself with that name.
+func New(ctx context.Context, name string, cfg Config) (OCIClient, error) {
+	mu.Lock()
+	factory, ok := factories[name]
+	mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("oci: unknown backend %q", name)
+	}
+	client, err := factory(ctx, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("oci: could not create %q backend: %w", name, err)
+	}
+	backendGauge.WithLabelValues(client.Name()).Set(1)
+	return client, nil
+}
@@ -0,0 +1,62 @@
+// Package piece splits a blob into fixed-size ranges and rotates peers
+// across them, similar to BitTorrent piece selection, so a large layer can
+// be fetched in parallel from multiple mirrors instead of a single one.
+package piece
+
+import (
+	"net/netip"
+	"sync"
+)
+
+// Piece describes one contiguous byte range of a blob.
+type Piece struct {
+	Index  int
+	Offset int64
+	Length int64
+}
+
+// Split divides a size-byte blob into pieces of at most pieceSize bytes
+// each, in order. It panics if size or pieceSize is not positive.
+func Split(size, pieceSize int64) []Piece {
+	if size <= 0 || pieceSize <= 0 {
+		panic("piece: size and pieceSize must be positive")
+	}
+	pieces := make([]Piece, 0, (size+pieceSize-1)/pieceSize)
+	for offset, index := int64(0), 0; offset < size; index++ {
+		length := pieceSize
+		if remaining := size - offset; remaining < length {
+			length = remaining
+		}
+		pieces = append(pieces, Piece{Index: index, Offset: offset, Length: length})
+		offset += length
+	}
+	return pieces
+}
+
+// Scheduler rotates through a fixed set of peers, handing out the next peer
+// to try for a piece while letting callers exclude peers that have already
+// failed it.
+type Scheduler struct {
+	mu    sync.Mutex
+	peers []netip.Addr
+	next  int
+}
+
+func NewScheduler(peers []netip.Addr) *Scheduler {
+	return &Scheduler{peers: peers}
+}
+
+// Next returns the next peer to try, skipping any address in exclude. It
+// returns ok=false once every peer has been excluded.
+func (s *Scheduler) Next(exclude map[netip.Addr]bool) (netip.Addr, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i < len(s.peers); i++ {
+		p := s.peers[s.next%len(s.peers)]
+		s.next++
+		if !exclude[p] {
+			return p, true
+		}
+	}
+	return netip.Addr{}, false
+}
@@ -0,0 +1,110 @@
+package piece
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestSplit(t *testing.T) {
+	cases := []struct {
+		name      string
+		size      int64
+		pieceSize int64
+		want      []Piece
+	}{
+		{
+			name:      "exact multiple",
+			size:      8,
+			pieceSize: 4,
+			want: []Piece{
+				{Index: 0, Offset: 0, Length: 4},
+				{Index: 1, Offset: 4, Length: 4},
+			},
+		},
+		{
+			name:      "remainder piece is shorter",
+			size:      10,
+			pieceSize: 4,
+			want: []Piece{
+				{Index: 0, Offset: 0, Length: 4},
+				{Index: 1, Offset: 4, Length: 4},
+				{Index: 2, Offset: 8, Length: 2},
+			},
+		},
+		{
+			name:      "single piece larger than size",
+			size:      3,
+			pieceSize: 4,
+			want: []Piece{
+				{Index: 0, Offset: 0, Length: 3},
+			},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := Split(tc.size, tc.pieceSize)
+			if len(got) != len(tc.want) {
+				t.Fatalf("Split(%d, %d) = %v, want %v", tc.size, tc.pieceSize, got, tc.want)
+			}
+			for i := range got {
+				if got[i] != tc.want[i] {
+					t.Errorf("Split(%d, %d)[%d] = %+v, want %+v", tc.size, tc.pieceSize, i, got[i], tc.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSplitPanicsOnNonPositive(t *testing.T) {
+	cases := []struct {
+		size      int64
+		pieceSize int64
+	}{
+		{size: 0, pieceSize: 4},
+		{size: -1, pieceSize: 4},
+		{size: 4, pieceSize: 0},
+		{size: 4, pieceSize: -1},
+	}
+	for _, tc := range cases {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Split(%d, %d) did not panic", tc.size, tc.pieceSize)
+				}
+			}()
+			Split(tc.size, tc.pieceSize)
+		}()
+	}
+}
+
+func TestSchedulerNextRotatesAndSkipsExcluded(t *testing.T) {
+	a := netip.MustParseAddr("10.0.0.1")
+	b := netip.MustParseAddr("10.0.0.2")
+	c := netip.MustParseAddr("10.0.0.3")
+	sched := NewScheduler([]netip.Addr{a, b, c})
+
+	p1, ok := sched.Next(nil)
+	if !ok || p1 != a {
+		t.Fatalf("Next() = %v, %v, want %v, true", p1, ok, a)
+	}
+	p2, ok := sched.Next(nil)
+	if !ok || p2 != b {
+		t.Fatalf("Next() = %v, %v, want %v, true", p2, ok, b)
+	}
+
+	p3, ok := sched.Next(map[netip.Addr]bool{c: true})
+	if !ok || p3 != a {
+		t.Fatalf("Next() with c excluded = %v, %v, want %v, true", p3, ok, a)
+	}
+}
+
+func TestSchedulerNextExhausted(t *testing.T) {
+	a := netip.MustParseAddr("10.0.0.1")
+	b := netip.MustParseAddr("10.0.0.2")
+	sched := NewScheduler([]netip.Addr{a, b})
+
+	_, ok := sched.Next(map[netip.Addr]bool{a: true, b: true})
+	if ok {
+		t.Fatalf("Next() with every peer excluded returned ok=true")
+	}
+}
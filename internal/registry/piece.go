@@ -0,0 +1,334 @@
+package registry
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/opencontainers/go-digest"
+
+	"github.com/xenitab/spegel/internal/piece"
+)
+
+// pieceFetchTimeout bounds a single piece GET. A peer that doesn't answer
+// within this window is treated the same as one that errored: the piece is
+// reassigned to the next peer in the rotation.
+const pieceFetchTimeout = 10 * time.Second
+
+// handleMirrorBlobPieces attempts to serve dgst by fetching it as fixed-size
+// pieces in parallel from multiple peers. It returns true if it fully
+// handled the request (served it or returned a terminal error), and false
+// if the caller should fall back to the normal single-peer mirror path.
+func (r *RegistryHandler) handleMirrorBlobPieces(c *gin.Context, key string, isExternal bool, dgst digest.Digest) bool {
+	resolveCtx, cancel := context.WithTimeout(c, 5*time.Second)
+	defer cancel()
+	candidateCh, err := r.router.ResolveN(resolveCtx, key, isExternal, mirrorCandidates)
+	if err != nil {
+		return false
+	}
+	peers := make([]netip.Addr, 0, mirrorCandidates)
+	for ip := range candidateCh {
+		if !r.negativeCache.isNegative(peerCacheKey(ip, key)) {
+			peers = append(peers, ip)
+		}
+	}
+	// Piece fetching needs more than one source to be worth the overhead.
+	if len(peers) < 2 {
+		return false
+	}
+
+	size, ok := r.headFirstResponsive(c, peers, dgst)
+	if !ok || size < r.blobParallelThreshold {
+		return false
+	}
+
+	c.Set("handler", "mirror")
+
+	failed := newFailedPeers()
+	if err := r.fetchBlobPieces(c, dgst, size, peers, failed); err != nil {
+		r.log.Error(err, "piece-parallel blob fetch failed", "digest", dgst.String())
+		// Only the peer(s) that actually failed a piece get negative-cached;
+		// a single flaky candidate among several otherwise-good ones
+		// shouldn't poison the rest for negativeCacheTTL.
+		for _, ip := range failed.list() {
+			r.negativeCache.markNegative(peerCacheKey(ip, key))
+		}
+		mirrorPeerAttemptsTotal.WithLabelValues("error").Inc()
+		return true
+	}
+	mirrorPeerAttemptsTotal.WithLabelValues("success").Inc()
+	return true
+}
+
+func peerCacheKey(ip netip.Addr, key string) string {
+	return fmt.Sprintf("%s|%s", ip, key)
+}
+
+// failedPeers collects the peers that actually failed to serve a piece
+// during one fetchBlobPieces call, so the caller can negative-cache just
+// them instead of every candidate peer that was handed to it.
+type failedPeers struct {
+	mu   sync.Mutex
+	seen map[netip.Addr]bool
+}
+
+func newFailedPeers() *failedPeers {
+	return &failedPeers{seen: map[netip.Addr]bool{}}
+}
+
+func (f *failedPeers) mark(ip netip.Addr) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.seen[ip] = true
+}
+
+func (f *failedPeers) list() []netip.Addr {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := make([]netip.Addr, 0, len(f.seen))
+	for ip := range f.seen {
+		out = append(out, ip)
+	}
+	return out
+}
+
+// headFirstResponsive issues a HEAD to each peer in turn and returns the
+// content length reported by the first one that confirms it holds dgst.
+func (r *RegistryHandler) headFirstResponsive(c *gin.Context, peers []netip.Addr, dgst digest.Digest) (int64, bool) {
+	for _, ip := range peers {
+		size, ok := r.headPeer(c, ip, dgst)
+		if ok {
+			return size, true
+		}
+	}
+	return 0, false
+}
+
+func (r *RegistryHandler) headPeer(c *gin.Context, ip netip.Addr, dgst digest.Digest) (int64, bool) {
+	ctx, cancel := context.WithTimeout(c, 2*time.Second)
+	defer cancel()
+
+	reqURL := url.URL{Scheme: "http", Host: net.JoinHostPort(ip.String(), r.registryPort), Path: c.Request.URL.Path, RawQuery: c.Request.URL.RawQuery}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, reqURL.String(), nil)
+	if err != nil {
+		return 0, false
+	}
+	req.Header = c.Request.Header.Clone()
+
+	resp, err := mirrorHTTPClient.Do(req)
+	if err != nil {
+		return 0, false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, false
+	}
+	if resp.Header.Get("Docker-Content-Digest") != dgst.String() {
+		return 0, false
+	}
+	size, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	if err != nil || size <= 0 {
+		return 0, false
+	}
+	return size, true
+}
+
+type pieceResult struct {
+	data []byte
+	err  error
+}
+
+// fetchBlobPieces splits dgst's size bytes into pieces, fetches them in
+// parallel from peers (bounded to pieceWorkers in flight), and streams them
+// to c.Writer strictly in order as soon as each arrives, verifying the
+// reassembled content against dgst as it goes.
+//
+// A 502 status is only possible up through piece 0: headers and a 200 are
+// committed to c.Writer as soon as the first piece is in hand, so a failure
+// caught after that (wrong length, a peer error, or the final digest check)
+// can no longer be turned into a 502 response. Instead abortConnection cuts
+// the TCP connection without completing it, so the client sees a failed
+// transfer (a short read against the declared Content-Length, or a broken
+// chunked trailer) rather than a clean 200 carrying truncated or corrupt
+// bytes. The error returned here is only for logging; failed records which
+// peer(s) actually failed a piece so the caller can negative-cache just
+// them instead of the whole candidate set.
+func (r *RegistryHandler) fetchBlobPieces(c *gin.Context, dgst digest.Digest, size int64, peers []netip.Addr, failed *failedPeers) error {
+	pieces := piece.Split(size, r.pieceSize)
+	sched := piece.NewScheduler(peers)
+
+	// Derive from the request's own context so a client disconnect cancels
+	// in-flight piece fetches.
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+
+	// sem bounds how far ahead of the writer the workers are allowed to
+	// fetch, keeping at most pieceWorkers pieces buffered in memory at once.
+	sem := make(chan struct{}, pieceWorkers)
+	results := make([]chan pieceResult, len(pieces))
+	for i := range results {
+		results[i] = make(chan pieceResult, 1)
+	}
+
+	go func() {
+		for _, p := range pieces {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			p := p
+			go func() {
+				data, err := r.fetchPieceWithRetry(ctx, c, sched, dgst, p, len(peers), failed)
+				results[p.Index] <- pieceResult{data: data, err: err}
+			}()
+		}
+	}()
+
+	hasher := sha256.New()
+	headersSent := false
+	for _, p := range pieces {
+		// The dispatcher can give up on ctx.Done() before every piece has
+		// been handed to a worker, in which case results[p.Index] is never
+		// written to; select on ctx here too so that race can't hang this
+		// loop forever waiting on a channel nothing will ever send on.
+		var res pieceResult
+		select {
+		case res = <-results[p.Index]:
+		case <-ctx.Done():
+			if !headersSent {
+				//nolint:errcheck // ignore
+				c.AbortWithError(http.StatusBadGateway, ctx.Err())
+			} else {
+				abortConnection(c)
+			}
+			return fmt.Errorf("piece %d: %w", p.Index, ctx.Err())
+		}
+		if res.err != nil {
+			cancel()
+			if !headersSent {
+				//nolint:errcheck // ignore
+				c.AbortWithError(http.StatusBadGateway, res.err)
+			} else {
+				abortConnection(c)
+			}
+			return fmt.Errorf("piece %d: %w", p.Index, res.err)
+		}
+		if int64(len(res.data)) != p.Length {
+			cancel()
+			if !headersSent {
+				//nolint:errcheck // ignore
+				c.AbortWithError(http.StatusBadGateway, fmt.Errorf("peer returned wrong length for piece %d", p.Index))
+			} else {
+				abortConnection(c)
+			}
+			return fmt.Errorf("piece %d: expected %d bytes, got %d", p.Index, p.Length, len(res.data))
+		}
+
+		if !headersSent {
+			c.Header("Content-Length", strconv.FormatInt(size, 10))
+			c.Header("Docker-Content-Digest", dgst.String())
+			c.Status(http.StatusOK)
+			headersSent = true
+		}
+
+		hasher.Write(res.data)
+		if _, err := c.Writer.Write(res.data); err != nil {
+			cancel()
+			return fmt.Errorf("piece %d: could not write to client: %w", p.Index, err)
+		}
+		<-sem
+	}
+
+	got := digest.NewDigestFromBytes(dgst.Algorithm(), hasher.Sum(nil))
+	if got != dgst {
+		// Headers and a 200 status are already committed by this point, so
+		// the only way to stop the client from accepting this as a
+		// successfully completed download is to abort the connection
+		// outright rather than let the handler return normally.
+		abortConnection(c)
+		return fmt.Errorf("reassembled digest %s does not match expected %s", got, dgst)
+	}
+	return nil
+}
+
+// abortConnection hijacks c's underlying connection and closes it
+// immediately, without writing a final chunk terminator or otherwise
+// completing the HTTP response. It is used once headers and a 200 status
+// have already been sent to c.Writer, where returning an error through gin
+// would otherwise let the response complete looking like a valid download;
+// closing the connection mid-stream makes the client observe the transfer
+// as failed instead.
+func abortConnection(c *gin.Context) {
+	hj, ok := c.Writer.(http.Hijacker)
+	if !ok {
+		return
+	}
+	conn, _, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+	//nolint:errcheck // best effort, we are discarding the connection anyway
+	conn.Close()
+}
+
+func (r *RegistryHandler) fetchPieceWithRetry(ctx context.Context, c *gin.Context, sched *piece.Scheduler, dgst digest.Digest, p piece.Piece, maxAttempts int, failed *failedPeers) ([]byte, error) {
+	excluded := map[netip.Addr]bool{}
+	var lastErr error
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		ip, ok := sched.Next(excluded)
+		if !ok {
+			break
+		}
+		data, err := r.fetchPieceFromPeer(ctx, c, ip, dgst, p)
+		if err == nil {
+			return data, nil
+		}
+		lastErr = err
+		excluded[ip] = true
+		failed.mark(ip)
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no peers available")
+	}
+	return nil, lastErr
+}
+
+func (r *RegistryHandler) fetchPieceFromPeer(ctx context.Context, c *gin.Context, ip netip.Addr, dgst digest.Digest, p piece.Piece) ([]byte, error) {
+	attemptCtx, cancel := context.WithTimeout(ctx, pieceFetchTimeout)
+	defer cancel()
+
+	reqURL := url.URL{Scheme: "http", Host: net.JoinHostPort(ip.String(), r.registryPort), Path: c.Request.URL.Path, RawQuery: c.Request.URL.RawQuery}
+	req, err := http.NewRequestWithContext(attemptCtx, http.MethodGet, reqURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = c.Request.Header.Clone()
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", p.Offset, p.Offset+p.Length-1))
+
+	resp, err := mirrorHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent && resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("peer %s returned status %d", ip, resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, p.Length+1))
+	if err != nil {
+		return nil, fmt.Errorf("peer %s: %w", ip, err)
+	}
+	if int64(len(data)) != p.Length {
+		return nil, fmt.Errorf("peer %s returned %d bytes, want %d", ip, len(data), p.Length)
+	}
+	return data, nil
+}
@@ -0,0 +1,200 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-logr/logr"
+	"github.com/opencontainers/go-digest"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// freeLoopbackPort finds a TCP port free on loopback, so the fake peers in
+// these tests can share one port across multiple addresses the way
+// RegistryHandler.registryPort assumes every peer does.
+func freeLoopbackPort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not find a free port: %v", err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+// startPeer serves Range requests against content on host:port. Ranges whose
+// offset is in stallOffsets block until either the request is cancelled or
+// unblock is closed, to simulate a peer that never answers a later piece.
+func startPeer(t *testing.T, host string, port int, content []byte, stallOffsets map[int64]bool, unblock <-chan struct{}) {
+	t.Helper()
+	ln, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		t.Fatalf("could not listen on %s:%d: %v", host, port, err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		off, n, ok := parseRangeHeader(req.Header.Get("Range"), int64(len(content)))
+		if !ok {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		if stallOffsets[off] {
+			select {
+			case <-unblock:
+			case <-req.Context().Done():
+				return
+			}
+		}
+		w.Header().Set("Content-Length", strconv.FormatInt(n, 10))
+		w.WriteHeader(http.StatusPartialContent)
+		//nolint:errcheck // test peer, nothing sensible to do with a write error
+		w.Write(content[off : off+n])
+	})}
+	go srv.Serve(ln)
+	t.Cleanup(func() {
+		//nolint:errcheck // best effort test cleanup
+		srv.Close()
+	})
+}
+
+// driveFetchBlobPieces runs r.fetchBlobPieces behind a real HTTP server
+// (rather than a bare gin.Context) so abortConnection can hijack a genuine
+// net.Conn the way it does in production, and so a client can observe the
+// difference between a clean response and one whose connection was cut.
+func driveFetchBlobPieces(t *testing.T, r *RegistryHandler, dgst digest.Digest, size int64, peers []netip.Addr) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c, _ := gin.CreateTestContext(w)
+		c.Request = req
+		//nolint:errcheck // the test asserts on what the client observed, not this return value
+		r.fetchBlobPieces(c, dgst, size, peers, newFailedPeers())
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestFetchBlobPiecesReassemblesInOrder(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 10) // 100 bytes, 7 pieces at size 16
+	dgst := digest.FromBytes(content)
+
+	port := freeLoopbackPort(t)
+	startPeer(t, "127.0.0.1", port, content, nil, nil)
+	startPeer(t, "127.0.0.2", port, content, nil, nil)
+	peers := []netip.Addr{netip.MustParseAddr("127.0.0.1"), netip.MustParseAddr("127.0.0.2")}
+
+	r := &RegistryHandler{log: logr.Discard(), registryPort: strconv.Itoa(port), pieceSize: 16}
+	srv := driveFetchBlobPieces(t, r, dgst, int64(len(content)), peers)
+
+	resp, err := http.Get(srv.URL + "/v2/test/blobs/" + dgst.String())
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if got := resp.Header.Get("Docker-Content-Digest"); got != dgst.String() {
+		t.Errorf("Docker-Content-Digest = %q, want %q", got, dgst.String())
+	}
+	got, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("could not read response body: %v", err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("reassembled body = %q, want %q", got, content)
+	}
+}
+
+func TestFetchBlobPiecesAbortsConnectionOnLateFailure(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 10) // 100 bytes, pieces at offsets 0,16,...,96
+	dgst := digest.FromBytes(content)
+
+	// Both peers serve piece 0 (so headers and a 200 are already committed)
+	// but stall on every later offset until pieceFetchTimeout cancels the
+	// attempt, so fetchPieceWithRetry exhausts both peers on piece 1 and
+	// fetchBlobPieces has to abort the connection instead of returning a
+	// clean error response.
+	stall := map[int64]bool{}
+	port := freeLoopbackPort(t)
+	for off := int64(16); off < int64(len(content)); off += 16 {
+		stall[off] = true
+	}
+	never := make(chan struct{}) // never closes: these offsets always stall until the request is cancelled
+	startPeer(t, "127.0.0.1", port, content, stall, never)
+	startPeer(t, "127.0.0.2", port, content, stall, never)
+	peers := []netip.Addr{netip.MustParseAddr("127.0.0.1"), netip.MustParseAddr("127.0.0.2")}
+
+	r := &RegistryHandler{log: logr.Discard(), registryPort: strconv.Itoa(port), pieceSize: 16}
+	srv := driveFetchBlobPieces(t, r, dgst, int64(len(content)), peers)
+
+	resp, err := http.Get(srv.URL + "/v2/test/blobs/" + dgst.String())
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d (headers are committed before piece 1 fails)", resp.StatusCode, http.StatusOK)
+	}
+	if _, err := io.ReadAll(resp.Body); err == nil {
+		t.Fatal("expected reading the body to fail once the connection was aborted mid-stream, got a complete read")
+	}
+}
+
+func TestFetchBlobPiecesStopsOnClientDisconnect(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 10)
+	dgst := digest.FromBytes(content)
+
+	// Piece 0 is served immediately; every later offset blocks until the
+	// client disconnects and the request context is cancelled, or the test
+	// cleans up.
+	stall := map[int64]bool{}
+	for off := int64(16); off < int64(len(content)); off += 16 {
+		stall[off] = true
+	}
+	unblock := make(chan struct{})
+	t.Cleanup(func() { close(unblock) })
+
+	port := freeLoopbackPort(t)
+	startPeer(t, "127.0.0.1", port, content, stall, unblock)
+	peers := []netip.Addr{netip.MustParseAddr("127.0.0.1")}
+
+	r := &RegistryHandler{log: logr.Discard(), registryPort: strconv.Itoa(port), pieceSize: 16}
+
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c, _ := gin.CreateTestContext(w)
+		c.Request = req
+		//nolint:errcheck // the client disconnects before this returns; the test only checks that it does return
+		r.fetchBlobPieces(c, dgst, int64(len(content)), peers, newFailedPeers())
+		close(done)
+	}))
+	t.Cleanup(srv.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/v2/test/blobs/"+dgst.String(), nil)
+	if err != nil {
+		t.Fatalf("could not build request: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err == nil {
+		resp.Body.Close()
+	}
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("fetchBlobPieces did not return after the client disconnected, it is likely stuck waiting on a peer that will never answer")
+	}
+}
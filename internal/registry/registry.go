@@ -2,20 +2,26 @@ package registry
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
-	"net/http/httputil"
+	"net/netip"
 	"net/url"
 	"path"
 	"regexp"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/containerd/containerd/images"
 	"github.com/gin-gonic/gin"
 	"github.com/go-logr/logr"
 	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	pkggin "github.com/xenitab/pkg/gin"
@@ -32,16 +38,94 @@ var mirrorRequestsTotal = promauto.NewCounterVec(
 	[]string{"registry", "cache", "source"},
 )
 
+var mirrorPeerAttemptsTotal = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "spegel_mirror_peer_attempts_total",
+		Help: "Total number of attempts to fetch from a mirror peer, by result.",
+	},
+	[]string{"result"},
+)
+
+// mirrorCandidates is how many peers handleMirror will ask the router for
+// before giving up and falling back to upstream.
+const mirrorCandidates = 5
+
+// negativeCacheTTL is how long a peer that just failed a mirror request is
+// skipped for, so a single flaky peer isn't retried on every subsequent
+// request for the same digest.
+const negativeCacheTTL = 10 * time.Second
+
+const (
+	// defaultBlobParallelThreshold is the default minimum blob size that
+	// triggers piece-parallel fetching.
+	defaultBlobParallelThreshold = 32 * 1024 * 1024
+	// defaultPieceSize is the default size of each piece fetched in parallel.
+	defaultPieceSize = 4 * 1024 * 1024
+	// pieceWorkers bounds how many pieces are fetched concurrently.
+	pieceWorkers = 4
+)
+
+// mirrorHTTPClient is shared across mirror attempts; per-attempt deadlines
+// are applied via the request context rather than the client's Timeout.
+var mirrorHTTPClient = &http.Client{}
+
+// Options holds everything needed to construct a Registry without Spegel
+// owning the lifecycle of its dependencies. It allows a host program to
+// supply an already-configured OCI client, router, and listener/server so
+// the registry can be embedded alongside a runtime the host already manages.
+type Options struct {
+	// Log is used for request and lifecycle logging. Defaults to a discard
+	// logger when unset.
+	Log logr.Logger
+	// OCIClient provides access to the local content store.
+	OCIClient oci.OCIClient
+	// Router resolves which peer holds a given image reference.
+	Router routing.Router
+	// Addr is the address the registry listens on. Ignored if Server is set
+	// with a non-empty Addr of its own.
+	Addr string
+	// Server allows a host program to provide a preconfigured *http.Server,
+	// for example one that shares a listener or TLS config with other
+	// components. When nil a server is created from Addr.
+	Server *http.Server
+
+	// BlobParallelPieces enables fetching blobs above BlobParallelThreshold
+	// as fixed-size pieces in parallel from multiple peers, similar to
+	// BitTorrent piece selection, instead of from a single mirror.
+	BlobParallelPieces bool
+	// BlobParallelThreshold is the minimum blob size that triggers piece
+	// fetching. Defaults to 32 MiB when zero.
+	BlobParallelThreshold int64
+	// PieceSize is the size of each piece fetched in parallel. Defaults to
+	// 4 MiB when zero.
+	PieceSize int64
+}
+
 type Registry struct {
+	log logr.Logger
 	srv *http.Server
 }
 
-func NewRegistry(ctx context.Context, addr string, ociClient oci.OCIClient, router routing.Router) (*Registry, error) {
-	_, registryPort, err := net.SplitHostPort(addr)
+func NewRegistry(ctx context.Context, opts Options) (*Registry, error) {
+	log := opts.Log
+	if log.GetSink() == nil {
+		log = logr.FromContextOrDiscard(ctx)
+	}
+
+	srv := opts.Server
+	if srv == nil {
+		srv = &http.Server{
+			Addr: opts.Addr,
+		}
+	}
+	if srv.Addr == "" {
+		srv.Addr = opts.Addr
+	}
+	_, registryPort, err := net.SplitHostPort(srv.Addr)
 	if err != nil {
 		return nil, err
 	}
-	log := logr.FromContextOrDiscard(ctx)
+
 	cfg := pkggin.Config{
 		LogConfig: pkggin.LogConfig{
 			Logger:          log,
@@ -54,50 +138,112 @@ func NewRegistry(ctx context.Context, addr string, ociClient oci.OCIClient, rout
 			HandlerID: "registry",
 		},
 	}
+	blobParallelThreshold := opts.BlobParallelThreshold
+	if blobParallelThreshold <= 0 {
+		blobParallelThreshold = defaultBlobParallelThreshold
+	}
+	pieceSize := opts.PieceSize
+	if pieceSize <= 0 {
+		pieceSize = defaultPieceSize
+	}
+
 	engine := pkggin.NewEngine(cfg)
 	registryHandler := &RegistryHandler{
-		log:          log,
-		ociClient:    ociClient,
-		router:       router,
-		registryPort: registryPort,
+		log:                   log,
+		ociClient:             opts.OCIClient,
+		router:                opts.Router,
+		registryPort:          registryPort,
+		negativeCache:         newNegativeCache(),
+		blobParallelPieces:    opts.BlobParallelPieces,
+		blobParallelThreshold: blobParallelThreshold,
+		pieceSize:             pieceSize,
 	}
 	engine.GET("/healthz", registryHandler.readyHandler)
 	engine.Any("/v2/*params", metricsHandler, registryHandler.registryHandler)
-	srv := &http.Server{
-		Addr:    addr,
-		Handler: engine,
-	}
+	srv.Handler = engine
 	return &Registry{
+		log: log,
 		srv: srv,
 	}, nil
 }
 
-func (r *Registry) ListenAndServe(ctx context.Context) error {
+// Start runs the registry server until ctx is cancelled or Shutdown is
+// called. It returns nil on a graceful shutdown.
+func (r *Registry) Start(ctx context.Context) error {
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-ctx.Done():
+			//nolint:errcheck // ListenAndServe below reports how the server stopped
+			r.Shutdown(context.Background())
+		case <-stopped:
+		}
+	}()
 	if err := r.srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		return err
 	}
 	return nil
 }
 
-func (r *Registry) Shutdown() error {
-	shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+// ListenAndServe is retained as an alias of Start for backwards compatibility.
+func (r *Registry) ListenAndServe(ctx context.Context) error {
+	return r.Start(ctx)
+}
+
+func (r *Registry) Shutdown(ctx context.Context) error {
+	shutdownCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 	return r.srv.Shutdown(shutdownCtx)
 }
 
 type RegistryHandler struct {
-	log          logr.Logger
-	ociClient    oci.OCIClient
-	router       routing.Router
-	registryPort string
+	log           logr.Logger
+	ociClient     oci.OCIClient
+	router        routing.Router
+	registryPort  string
+	negativeCache *negativeCache
+
+	blobParallelPieces    bool
+	blobParallelThreshold int64
+	pieceSize             int64
+}
+
+// negativeCache remembers peers that just failed a mirror request for a
+// given key, so they are not retried again for the next few seconds.
+type negativeCache struct {
+	mu      sync.Mutex
+	entries map[string]time.Time
+}
+
+func newNegativeCache() *negativeCache {
+	return &negativeCache{entries: map[string]time.Time{}}
+}
+
+func (n *negativeCache) isNegative(key string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	expiresAt, ok := n.entries[key]
+	if !ok {
+		return false
+	}
+	if time.Now().After(expiresAt) {
+		delete(n.entries, key)
+		return false
+	}
+	return true
+}
+
+func (n *negativeCache) markNegative(key string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.entries[key] = time.Now().Add(negativeCacheTTL)
 }
 
 func (r *RegistryHandler) readyHandler(c *gin.Context) {
 	c.Status(http.StatusOK)
 }
 
-// TODO: Explore using leases to make sure resources are not deleted mid request.
-// https://github.com/containerd/containerd/blob/main/docs/garbage-collection.md
 func (r *RegistryHandler) registryHandler(c *gin.Context) {
 	// Only deal with GET and HEAD requests.
 	if !(c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead) {
@@ -157,7 +303,6 @@ func (r *RegistryHandler) registryHandler(c *gin.Context) {
 	c.Status(http.StatusNotFound)
 }
 
-// TODO: Retry multiple endoints
 func (r *RegistryHandler) handleMirror(c *gin.Context, remoteRegistry string) {
 	c.Set("handler", "mirror")
 
@@ -188,42 +333,155 @@ func (r *RegistryHandler) handleMirror(c *gin.Context, remoteRegistry string) {
 		r.log.Info("handling mirror request from external node", "path", c.Request.URL.Path, "ip", c.RemoteIP())
 	}
 
-	// Resolve node with the requested key
-	timeoutCtx, cancel := context.WithTimeout(c, 5*time.Second)
+	// Large blobs can be fetched as parallel pieces from multiple peers
+	// instead of streamed from a single one. This falls back to the normal
+	// single-peer path below whenever it isn't applicable (disabled, not a
+	// blob, too small, or fewer than two peers had it).
+	if r.blobParallelPieces && c.Request.Method == http.MethodGet {
+		if blobRef, ok, err := BlobReference(remoteRegistry, c.Request.URL.Path); err == nil && ok {
+			if r.handleMirrorBlobPieces(c, key, isExternal, blobRef.Digest()) {
+				return
+			}
+		}
+	}
+
+	// Resolve a handful of candidate peers up front and try them in order,
+	// skipping anything recently marked negative, rather than committing to
+	// a single peer that may be slow or gone.
+	resolveCtx, cancel := context.WithTimeout(c, 5*time.Second)
 	defer cancel()
-	ip, ok, err := r.router.Resolve(timeoutCtx, key, isExternal)
+	candidates, err := r.router.ResolveN(resolveCtx, key, isExternal, mirrorCandidates)
 	if err != nil {
 		//nolint:errcheck // ignore
 		c.AbortWithError(http.StatusNotFound, err)
 		return
 	}
-	if !ok {
-		//nolint:errcheck // ignore
-		c.AbortWithError(http.StatusNotFound, fmt.Errorf("could not find node with ref: %s", ref.String()))
+
+	attemptTimeout := 2 * time.Second
+	if c.Request.Method == http.MethodGet {
+		attemptTimeout = 10 * time.Second
+	}
+
+	for ip := range candidates {
+		cacheKey := fmt.Sprintf("%s|%s", ip, key)
+		if r.negativeCache.isNegative(cacheKey) {
+			mirrorPeerAttemptsTotal.WithLabelValues("skipped").Inc()
+			continue
+		}
+
+		served, err := r.attemptMirror(c, ip, attemptTimeout)
+		if err != nil {
+			r.log.V(5).Info("mirror attempt failed", "ip", ip.String(), "path", c.Request.URL.Path, "err", err.Error())
+			r.negativeCache.markNegative(cacheKey)
+			mirrorPeerAttemptsTotal.WithLabelValues("error").Inc()
+			continue
+		}
+		if !served {
+			r.negativeCache.markNegative(cacheKey)
+			mirrorPeerAttemptsTotal.WithLabelValues("miss").Inc()
+			continue
+		}
+		mirrorPeerAttemptsTotal.WithLabelValues("success").Inc()
 		return
 	}
 
-	// Proxy the request to another registry
-	url, err := url.Parse(fmt.Sprintf("http://%s:%s", ip, r.registryPort))
+	// No candidate served the request; let containerd fall back to the next
+	// configured mirror (or upstream).
+	//nolint:errcheck // ignore
+	c.AbortWithError(http.StatusNotFound, fmt.Errorf("could not find node with ref: %s", ref.String()))
+}
+
+// attemptMirror forwards c's GET/HEAD request to ip and streams a
+// successful response to c.Writer. It returns served=false for anything
+// other than a 200/206 response from the peer (so the caller can try the
+// next candidate instead of forwarding a 404/5xx straight to the client) and
+// a non-nil error only for a connection-level failure. The request is safe
+// to replay because registryHandler only ever reaches here for GET and HEAD.
+func (r *RegistryHandler) attemptMirror(c *gin.Context, ip netip.Addr, timeout time.Duration) (served bool, err error) {
+	attemptCtx, cancel := context.WithTimeout(c, timeout)
+	defer cancel()
+
+	reqURL := url.URL{
+		Scheme:   "http",
+		Host:     net.JoinHostPort(ip.String(), r.registryPort),
+		Path:     c.Request.URL.Path,
+		RawQuery: c.Request.URL.RawQuery,
+	}
+	req, err := http.NewRequestWithContext(attemptCtx, c.Request.Method, reqURL.String(), nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header = c.Request.Header.Clone()
+
+	r.log.V(5).Info("forwarding request", "path", c.Request.URL.Path, "url", reqURL.String())
+	resp, err := mirrorHTTPClient.Do(req)
 	if err != nil {
-		//nolint:errcheck // ignore
-		c.AbortWithError(http.StatusNotFound, err)
-		return
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return false, nil
 	}
-	r.log.V(5).Info("forwarding request", "path", c.Request.URL.Path, "url", url.String())
-	proxy := httputil.NewSingleHostReverseProxy(url)
-	proxy.ServeHTTP(c.Writer, c.Request)
+
+	for k, vv := range resp.Header {
+		for _, v := range vv {
+			c.Writer.Header().Add(k, v)
+		}
+	}
+	c.Writer.WriteHeader(resp.StatusCode)
+	if c.Request.Method != http.MethodHead {
+		if _, err := io.Copy(c.Writer, resp.Body); err != nil {
+			r.log.Error(err, "error copying mirror response body", "ip", ip.String())
+		}
+	}
+	return true, nil
 }
 
 func (r *RegistryHandler) handleManifest(c *gin.Context, dgst digest.Digest) {
 	c.Set("handler", "manifest")
 
-	b, mediaType, err := r.ociClient.GetContent(c, dgst)
+	// Hold a lease for the duration of this response so a concurrent GC
+	// pass triggered by image removal cannot delete the manifest out from
+	// under us. Lease acquisition failures are surfaced as 503 rather than
+	// 404 so peers know to retry a different mirror instead of treating
+	// this as a permanent miss.
+	leaseCtx, releaseLease, err := r.ociClient.WithLease(c, dgst)
+	if err != nil {
+		//nolint:errcheck // ignore
+		c.AbortWithError(http.StatusServiceUnavailable, err)
+		return
+	}
+	defer func() {
+		if err := releaseLease(); err != nil {
+			r.log.Error(err, "could not release manifest lease", "digest", dgst.String())
+		}
+	}()
+
+	b, mediaType, err := r.ociClient.GetContent(leaseCtx, dgst)
 	if err != nil {
 		//nolint:errcheck // ignore
 		c.AbortWithError(http.StatusNotFound, err)
 		return
 	}
+
+	// Extend the lease to cover the config and layers referenced by this
+	// manifest, since the client is expected to request them next and they
+	// are just as vulnerable to a racing GC pass.
+	if descs, err := manifestDescriptors(mediaType, b); err != nil {
+		r.log.Error(err, "could not parse manifest descriptors", "digest", dgst.String())
+	} else if len(descs) > 0 {
+		if _, releaseContentLease, err := r.ociClient.WithLease(leaseCtx, descs...); err != nil {
+			r.log.Error(err, "could not extend lease to manifest content", "digest", dgst.String())
+		} else {
+			defer func() {
+				if err := releaseContentLease(); err != nil {
+					r.log.Error(err, "could not release manifest content lease", "digest", dgst.String())
+				}
+			}()
+		}
+	}
+
 	c.Header("Content-Type", mediaType)
 	c.Header("Content-Length", strconv.FormatInt(int64(len(b)), 10))
 	c.Header("Docker-Content-Digest", dgst.String())
@@ -243,19 +501,50 @@ func (r *RegistryHandler) handleManifest(c *gin.Context, dgst digest.Digest) {
 func (r *RegistryHandler) handleBlob(c *gin.Context, dgst digest.Digest) {
 	c.Set("handler", "blob")
 
-	size, err := r.ociClient.GetSize(c, dgst)
+	leaseCtx, releaseLease, err := r.ociClient.WithLease(c, dgst)
+	if err != nil {
+		//nolint:errcheck // ignore
+		c.AbortWithError(http.StatusServiceUnavailable, err)
+		return
+	}
+	defer func() {
+		if err := releaseLease(); err != nil {
+			r.log.Error(err, "could not release blob lease", "digest", dgst.String())
+		}
+	}()
+
+	size, err := r.ociClient.GetSize(leaseCtx, dgst)
 	if err != nil {
 		//nolint:errcheck // ignore
 		c.AbortWithError(http.StatusNotFound, err)
 		return
 	}
-	c.Header("Content-Length", strconv.FormatInt(size, 10))
 	c.Header("Docker-Content-Digest", dgst.String())
+
+	// A Range request is how a peer fetches one piece of this blob as part
+	// of piece-parallel fetching (see handleMirrorBlobPieces); honor it so
+	// the requesting peer doesn't have to pull the whole blob.
+	if rangeHeader := c.GetHeader("Range"); rangeHeader != "" && c.Request.Method == http.MethodGet {
+		off, n, ok := parseRangeHeader(rangeHeader, size)
+		if !ok {
+			c.Status(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		c.Header("Content-Range", fmt.Sprintf("bytes %d-%d/%d", off, off+n-1, size))
+		c.Header("Content-Length", strconv.FormatInt(n, 10))
+		c.Status(http.StatusPartialContent)
+		if err := r.ociClient.CopyRange(leaseCtx, dgst, off, n, c.Writer); err != nil {
+			r.log.Error(err, "could not copy blob range", "digest", dgst.String())
+		}
+		return
+	}
+
+	c.Header("Content-Length", strconv.FormatInt(size, 10))
 	if c.Request.Method == http.MethodHead {
 		c.Status(http.StatusOK)
 		return
 	}
-	err = r.ociClient.Copy(c, dgst, c.Writer)
+	err = r.ociClient.Copy(leaseCtx, dgst, c.Writer)
 	if err != nil {
 		//nolint:errcheck // ignore
 		c.AbortWithError(http.StatusNotFound, err)
@@ -264,6 +553,64 @@ func (r *RegistryHandler) handleBlob(c *gin.Context, dgst digest.Digest) {
 	c.Status(http.StatusOK)
 }
 
+// parseRangeHeader parses a single-range "bytes=start-end" Range header
+// value against a resource of the given size, returning the offset and
+// length of the requested range. Only a single range is supported, which is
+// all handleMirrorBlobPieces ever sends.
+func parseRangeHeader(v string, size int64) (off, n int64, ok bool) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(v, prefix) {
+		return 0, 0, false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(v, prefix), "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false
+	}
+	end, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || end < start {
+		return 0, 0, false
+	}
+	if end >= size {
+		end = size - 1
+	}
+	return start, end - start + 1, true
+}
+
+// manifestDescriptors returns the content digests referenced by a manifest
+// or index, so they can be covered by the same lease as the manifest
+// itself. It returns nil for media types it does not recognize.
+func manifestDescriptors(mediaType string, b []byte) ([]digest.Digest, error) {
+	switch mediaType {
+	case ocispec.MediaTypeImageManifest, images.MediaTypeDockerSchema2Manifest:
+		var m ocispec.Manifest
+		if err := json.Unmarshal(b, &m); err != nil {
+			return nil, fmt.Errorf("could not unmarshal manifest: %w", err)
+		}
+		digests := make([]digest.Digest, 0, len(m.Layers)+1)
+		digests = append(digests, m.Config.Digest)
+		for _, l := range m.Layers {
+			digests = append(digests, l.Digest)
+		}
+		return digests, nil
+	case ocispec.MediaTypeImageIndex, images.MediaTypeDockerSchema2ManifestList:
+		var idx ocispec.Index
+		if err := json.Unmarshal(b, &idx); err != nil {
+			return nil, fmt.Errorf("could not unmarshal index: %w", err)
+		}
+		digests := make([]digest.Digest, 0, len(idx.Manifests))
+		for _, m := range idx.Manifests {
+			digests = append(digests, m.Digest)
+		}
+		return digests, nil
+	default:
+		return nil, nil
+	}
+}
+
 func metricsHandler(c *gin.Context) {
 	c.Next()
 	handler, ok := c.Get("handler")
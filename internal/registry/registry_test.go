@@ -0,0 +1,169 @@
+package registry
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestNegativeCache(t *testing.T) {
+	n := newNegativeCache()
+
+	if n.isNegative("peer|key") {
+		t.Fatalf("isNegative() = true before markNegative was ever called")
+	}
+
+	n.markNegative("peer|key")
+	if !n.isNegative("peer|key") {
+		t.Fatalf("isNegative() = false right after markNegative")
+	}
+
+	// A key that was never marked stays unaffected.
+	if n.isNegative("other|key") {
+		t.Fatalf("isNegative() = true for a key that was never marked")
+	}
+
+	// Force the entry to have expired in the past and confirm it is treated
+	// as expired and cleaned up.
+	n.mu.Lock()
+	n.entries["peer|key"] = time.Now().Add(-time.Second)
+	n.mu.Unlock()
+	if n.isNegative("peer|key") {
+		t.Fatalf("isNegative() = true for an expired entry")
+	}
+	n.mu.Lock()
+	_, ok := n.entries["peer|key"]
+	n.mu.Unlock()
+	if ok {
+		t.Fatalf("expired entry was not removed from the cache")
+	}
+}
+
+func TestParseRangeHeader(t *testing.T) {
+	const size = int64(100)
+
+	cases := []struct {
+		name    string
+		header  string
+		wantOff int64
+		wantN   int64
+		wantOK  bool
+	}{
+		{name: "valid range", header: "bytes=0-9", wantOff: 0, wantN: 10, wantOK: true},
+		{name: "valid range not starting at 0", header: "bytes=10-19", wantOff: 10, wantN: 10, wantOK: true},
+		{name: "end clamped to size", header: "bytes=90-999", wantOff: 90, wantN: 10, wantOK: true},
+		{name: "missing prefix", header: "0-9", wantOK: false},
+		{name: "missing dash", header: "bytes=10", wantOK: false},
+		{name: "non-numeric start", header: "bytes=a-9", wantOK: false},
+		{name: "non-numeric end", header: "bytes=0-b", wantOK: false},
+		{name: "start beyond size", header: "bytes=100-110", wantOK: false},
+		{name: "negative start", header: "bytes=-5-9", wantOK: false},
+		{name: "end before start", header: "bytes=10-5", wantOK: false},
+		{name: "empty", header: "", wantOK: false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			off, n, ok := parseRangeHeader(tc.header, size)
+			if ok != tc.wantOK {
+				t.Fatalf("parseRangeHeader(%q, %d) ok = %v, want %v", tc.header, size, ok, tc.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if off != tc.wantOff || n != tc.wantN {
+				t.Errorf("parseRangeHeader(%q, %d) = (%d, %d), want (%d, %d)", tc.header, size, off, n, tc.wantOff, tc.wantN)
+			}
+		})
+	}
+}
+
+func TestManifestDescriptors(t *testing.T) {
+	t.Run("image manifest", func(t *testing.T) {
+		m := ocispec.Manifest{
+			Config: ocispec.Descriptor{Digest: digest.FromString("config")},
+			Layers: []ocispec.Descriptor{
+				{Digest: digest.FromString("layer1")},
+				{Digest: digest.FromString("layer2")},
+			},
+		}
+		b, err := json.Marshal(m)
+		if err != nil {
+			t.Fatalf("could not marshal manifest: %v", err)
+		}
+		descs, err := manifestDescriptors(ocispec.MediaTypeImageManifest, b)
+		if err != nil {
+			t.Fatalf("manifestDescriptors() error = %v", err)
+		}
+		want := []digest.Digest{m.Config.Digest, m.Layers[0].Digest, m.Layers[1].Digest}
+		if len(descs) != len(want) {
+			t.Fatalf("manifestDescriptors() = %v, want %v", descs, want)
+		}
+		for i := range want {
+			if descs[i] != want[i] {
+				t.Errorf("manifestDescriptors()[%d] = %v, want %v", i, descs[i], want[i])
+			}
+		}
+	})
+
+	t.Run("image index", func(t *testing.T) {
+		idx := ocispec.Index{
+			Manifests: []ocispec.Descriptor{
+				{Digest: digest.FromString("manifest1")},
+				{Digest: digest.FromString("manifest2")},
+			},
+		}
+		b, err := json.Marshal(idx)
+		if err != nil {
+			t.Fatalf("could not marshal index: %v", err)
+		}
+		descs, err := manifestDescriptors(ocispec.MediaTypeImageIndex, b)
+		if err != nil {
+			t.Fatalf("manifestDescriptors() error = %v", err)
+		}
+		want := []digest.Digest{idx.Manifests[0].Digest, idx.Manifests[1].Digest}
+		if len(descs) != len(want) {
+			t.Fatalf("manifestDescriptors() = %v, want %v", descs, want)
+		}
+		for i := range want {
+			if descs[i] != want[i] {
+				t.Errorf("manifestDescriptors()[%d] = %v, want %v", i, descs[i], want[i])
+			}
+		}
+	})
+
+	t.Run("docker schema2 manifest", func(t *testing.T) {
+		m := ocispec.Manifest{Config: ocispec.Descriptor{Digest: digest.FromString("config")}}
+		b, err := json.Marshal(m)
+		if err != nil {
+			t.Fatalf("could not marshal manifest: %v", err)
+		}
+		descs, err := manifestDescriptors(images.MediaTypeDockerSchema2Manifest, b)
+		if err != nil {
+			t.Fatalf("manifestDescriptors() error = %v", err)
+		}
+		if len(descs) != 1 || descs[0] != m.Config.Digest {
+			t.Errorf("manifestDescriptors() = %v, want [%v]", descs, m.Config.Digest)
+		}
+	})
+
+	t.Run("unrecognized media type returns no error", func(t *testing.T) {
+		descs, err := manifestDescriptors("application/octet-stream", []byte("not json"))
+		if err != nil {
+			t.Fatalf("manifestDescriptors() error = %v, want nil", err)
+		}
+		if descs != nil {
+			t.Errorf("manifestDescriptors() = %v, want nil", descs)
+		}
+	})
+
+	t.Run("bad json returns error", func(t *testing.T) {
+		_, err := manifestDescriptors(ocispec.MediaTypeImageManifest, []byte("not json"))
+		if err == nil {
+			t.Fatalf("manifestDescriptors() error = nil, want non-nil")
+		}
+	})
+}
@@ -0,0 +1,28 @@
+package routing
+
+import "context"
+
+// BootstrapSource supplies the initial set of peers a P2P router uses to
+// join the DHT. NewKubernetesBootstrapper is the default implementation,
+// discovering peers through leader election against a Kubernetes ConfigMap.
+// Host programs that embed Spegel can implement BootstrapSource themselves
+// to supply peers from whatever topology they already track, without
+// requiring a Kubernetes API server.
+type BootstrapSource interface {
+	// Bootstrap returns the multiaddrs of peers to dial when joining the
+	// DHT. It may block until peers are known and should respect ctx
+	// cancellation.
+	Bootstrap(ctx context.Context) ([]string, error)
+}
+
+// StaticBootstrapSource is a BootstrapSource that always returns a fixed
+// list of peer addresses. It is useful for host programs that already know
+// their peer topology and want to embed the router without standing up
+// leader election.
+type StaticBootstrapSource struct {
+	Peers []string
+}
+
+func (s StaticBootstrapSource) Bootstrap(ctx context.Context) ([]string, error) {
+	return s.Peers, nil
+}
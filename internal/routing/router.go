@@ -0,0 +1,24 @@
+package routing
+
+import (
+	"context"
+	"net/netip"
+)
+
+// Router resolves which peer in the DHT holds a given image reference.
+type Router interface {
+	// Resolve returns the single best peer for key, or ok=false if none
+	// could be found before ctx is done.
+	Resolve(ctx context.Context, key string, isExternal bool) (netip.Addr, bool, error)
+	// ResolveN streams up to n candidate peers for key as the DHT provider
+	// search progresses, closest/most-recently-seen first. The channel is
+	// closed once n candidates have been found, the search is exhausted, or
+	// ctx is done, whichever happens first.
+	ResolveN(ctx context.Context, key string, isExternal bool, n int) (<-chan netip.Addr, error)
+	// Advertise announces that the local peer holds the content identified
+	// by each of keys, so a future Resolve/ResolveN call for any of them
+	// can return this peer. Used by state.Track to publish the images the
+	// local OCI backend has.
+	Advertise(ctx context.Context, keys []string) error
+	Close() error
+}
@@ -0,0 +1,65 @@
+// Package state advertises the images the local OCI backend has onto the
+// router, so peers can resolve this node when they mirror one of them.
+package state
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"regexp"
+
+	"github.com/go-logr/logr"
+
+	"github.com/xenitab/spegel/internal/oci"
+	"github.com/xenitab/spegel/internal/routing"
+)
+
+// Track advertises every image reported on events, filtered to registries
+// and imageFilter, until ctx is cancelled or events is closed. events is a
+// backend-agnostic stream: it may come from containerd, CRI-O, or Podman,
+// and Track does not care which.
+func Track(ctx context.Context, events <-chan oci.ImageEvent, router routing.Router, registries []url.URL, imageFilter string) error {
+	log := logr.FromContextOrDiscard(ctx)
+
+	var filter *regexp.Regexp
+	if imageFilter != "" {
+		var err error
+		filter, err = regexp.Compile(imageFilter)
+		if err != nil {
+			return fmt.Errorf("could not compile image filter %q: %w", imageFilter, err)
+		}
+	}
+	allowed := make(map[string]bool, len(registries))
+	for _, registry := range registries {
+		allowed[registry.Host] = true
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-events:
+			if !ok {
+				return nil
+			}
+			if event.Type == oci.EventTypeDelete {
+				// Entries are left to expire from the DHT on their own;
+				// Router has no withdrawal mechanism.
+				continue
+			}
+			if len(allowed) > 0 && !allowed[event.Image.Registry] {
+				continue
+			}
+			if filter != nil && !filter.MatchString(event.Image.Repository) {
+				continue
+			}
+			keys := []string{
+				event.Image.Digest.String(),
+				fmt.Sprintf("%s/%s:%s", event.Image.Registry, event.Image.Repository, event.Image.Tag),
+			}
+			if err := router.Advertise(ctx, keys); err != nil {
+				log.Error(err, "could not advertise image", "repository", event.Image.Repository, "tag", event.Image.Tag)
+			}
+		}
+	}
+}
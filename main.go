@@ -12,7 +12,6 @@ import (
 	"time"
 
 	"github.com/alexflint/go-arg"
-	"github.com/containerd/containerd"
 	"github.com/go-logr/logr"
 	"github.com/go-logr/zapr"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -22,10 +21,11 @@ import (
 
 	pkgkubernetes "github.com/xenitab/pkg/kubernetes"
 	"github.com/xenitab/spegel/internal/mirror"
-	"github.com/xenitab/spegel/internal/registry"
+	"github.com/xenitab/spegel/internal/oci"
+	_ "github.com/xenitab/spegel/internal/oci/containerd"
+	_ "github.com/xenitab/spegel/internal/oci/cstorage"
 	"github.com/xenitab/spegel/internal/routing"
-	"github.com/xenitab/spegel/internal/state"
-	"github.com/xenitab/spegel/internal/webhook"
+	"github.com/xenitab/spegel/pkg/spegel"
 )
 
 type ConfigurationCmd struct {
@@ -40,14 +40,18 @@ type RegistryCmd struct {
 	MetricsAddr             string    `arg:"--metrics-addr,required" help:"address to serve metrics."`
 	Registries              []url.URL `arg:"--registries,required" help:"registries that are configured to be mirrored."`
 	ImageFilter             string    `arg:"--image-filter" help:"inclusive image name filter."`
+	OCIBackend              string    `arg:"--oci-backend" default:"containerd" help:"OCI backend to read images from. One of: containerd, cri-o."`
 	ContainerdSock          string    `arg:"--containerd-sock" default:"/run/containerd/containerd.sock" help:"Endpoint of containerd service."`
 	ContainerdNamespace     string    `arg:"--containerd-namespace" default:"k8s.io" help:"Containerd namespace to fetch images from."`
+	CriOStorageRoot         string    `arg:"--cri-o-storage-root" default:"/var/lib/containers/storage" help:"Graph root of the CRI-O/Podman containers/storage store."`
+	CriOStorageDriver       string    `arg:"--cri-o-storage-driver" default:"overlay" help:"Graph driver of the CRI-O/Podman containers/storage store."`
 	KubeconfigPath          string    `arg:"--kubeconfig-path" help:"Path to the kubeconfig file."`
 	LeaderElectionNamespace string    `arg:"--leader-election-namespace" default:"spegel" help:"Kubernetes namespace to write leader election data."`
 	LeaderElectionName      string    `arg:"--leader-election-name" default:"spegel-leader-election" help:"Name of leader election."`
 	SelfBootstrapEnabled    bool      `arg:"--self-bootstrap-enabled" help:"if true self bootstrap webhook will be enabled."`
 	WebhookAddr             string    `arg:"--webhook-addr" help:"address to serve webhook."`
 	SelfBootstrapAddr       string    `arg:"--self-bootstrap-addr" help:"address to use as a self bootstrap registry."`
+	BlobParallelPieces      bool      `arg:"--blob-parallel-pieces" help:"if true large blobs are fetched as parallel pieces from multiple peers."`
 }
 
 type Arguments struct {
@@ -96,6 +100,9 @@ func configurationCommand(ctx context.Context, args *ConfigurationCmd) error {
 	return nil
 }
 
+// registryCommand is a thin wrapper around pkg/spegel: it parses CLI-only
+// concerns (Kubernetes clientset, OCI backend client, metrics endpoint) and
+// hands everything else to the embeddable library.
 func registryCommand(ctx context.Context, args *RegistryCmd) (err error) {
 	log := logr.FromContextOrDiscard(ctx)
 	g, ctx := errgroup.WithContext(ctx)
@@ -104,12 +111,17 @@ func registryCommand(ctx context.Context, args *RegistryCmd) (err error) {
 	if err != nil {
 		return err
 	}
-	containerdClient, err := containerd.New(args.ContainerdSock, containerd.WithDefaultNamespace(args.ContainerdNamespace))
+	ociClient, err := oci.New(ctx, args.OCIBackend, oci.Config{
+		ContainerdSock:      args.ContainerdSock,
+		ContainerdNamespace: args.ContainerdNamespace,
+		CriOStorageRoot:     args.CriOStorageRoot,
+		CriOStorageDriver:   args.CriOStorageDriver,
+	})
 	if err != nil {
-		return fmt.Errorf("could not create containerd client: %w", err)
+		return err
 	}
 	defer func() {
-		err = errors.Join(err, containerdClient.Close())
+		err = errors.Join(err, ociClient.Close())
 	}()
 
 	mux := http.NewServeMux()
@@ -131,45 +143,32 @@ func registryCommand(ctx context.Context, args *RegistryCmd) (err error) {
 		return srv.Shutdown(shutdownCtx)
 	})
 
-	bootstrapper := routing.NewKubernetesBootstrapper(cs, args.LeaderElectionNamespace, args.LeaderElectionName)
-	router, err := routing.NewP2PRouter(ctx, args.RouterAddr, bootstrapper)
-	if err != nil {
-		return err
-	}
-	g.Go(func() error {
-		<-ctx.Done()
-		return router.Close()
-	})
-	g.Go(func() error {
-		return state.Track(ctx, containerdClient, router, args.Registries, args.ImageFilter)
+	sp, err := spegel.New(ctx, spegel.Options{
+		Log:                  log,
+		OCIClient:            ociClient,
+		BootstrapSource:      routing.NewKubernetesBootstrapper(cs, args.LeaderElectionNamespace, args.LeaderElectionName),
+		RouterAddr:           args.RouterAddr,
+		RegistryAddr:         args.RegistryAddr,
+		Registries:           args.Registries,
+		ImageFilter:          args.ImageFilter,
+		SelfBootstrapEnabled: args.SelfBootstrapEnabled,
+		WebhookAddr:          args.WebhookAddr,
+		SelfBootstrapAddr:    args.SelfBootstrapAddr,
+		BlobParallelPieces:   args.BlobParallelPieces,
 	})
-
-	reg, err := registry.NewRegistry(ctx, args.RegistryAddr, containerdClient, router)
 	if err != nil {
 		return err
 	}
 	g.Go(func() error {
-		return reg.ListenAndServe(ctx)
+		return sp.Start(ctx)
 	})
 	g.Go(func() error {
 		<-ctx.Done()
-		return reg.Shutdown()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		return sp.Shutdown(shutdownCtx)
 	})
 
-	if args.SelfBootstrapEnabled {
-		wbk, err := webhook.NewWebhook(ctx, args.WebhookAddr, args.SelfBootstrapAddr, router)
-		if err != nil {
-			return err
-		}
-		g.Go(func() error {
-			return wbk.ListenAndServe(ctx)
-		})
-		g.Go(func() error {
-			<-ctx.Done()
-			return wbk.Shutdown()
-		})
-	}
-
 	log.Info("running registry", "addr", args.RegistryAddr)
 	err = g.Wait()
 	if err != nil {
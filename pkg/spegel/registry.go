@@ -0,0 +1,26 @@
+package spegel
+
+import (
+	"context"
+
+	"github.com/xenitab/spegel/internal/oci"
+	"github.com/xenitab/spegel/internal/registry"
+	"github.com/xenitab/spegel/internal/routing"
+)
+
+// NewRegistry creates the OCI registry endpoint component.
+func NewRegistry(ctx context.Context, ociClient oci.OCIClient, router routing.Router, opts Options) (*registry.Registry, Component, error) {
+	reg, err := registry.NewRegistry(ctx, registry.Options{
+		Log:                   opts.Log,
+		OCIClient:             ociClient,
+		Router:                router,
+		Addr:                  opts.RegistryAddr,
+		BlobParallelPieces:    opts.BlobParallelPieces,
+		BlobParallelThreshold: opts.BlobParallelThreshold,
+		PieceSize:             opts.PieceSize,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return reg, reg, nil
+}
@@ -0,0 +1,36 @@
+package spegel
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/xenitab/spegel/internal/routing"
+)
+
+type routerComponent struct {
+	router routing.Router
+}
+
+// NewRouter creates the P2P router component. opts.BootstrapSource must be
+// set; the CLI wrapper in main.go supplies routing.NewKubernetesBootstrapper,
+// but an embedding host program may supply its own to join the DHT without
+// a Kubernetes API server.
+func NewRouter(ctx context.Context, opts Options) (routing.Router, Component, error) {
+	if opts.BootstrapSource == nil {
+		return nil, nil, fmt.Errorf("spegel: Options.BootstrapSource is required to create a router")
+	}
+	router, err := routing.NewP2PRouter(ctx, opts.RouterAddr, opts.BootstrapSource)
+	if err != nil {
+		return nil, nil, err
+	}
+	return router, &routerComponent{router: router}, nil
+}
+
+func (r *routerComponent) Start(ctx context.Context) error {
+	<-ctx.Done()
+	return nil
+}
+
+func (r *routerComponent) Shutdown(ctx context.Context) error {
+	return r.router.Close()
+}
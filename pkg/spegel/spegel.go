@@ -0,0 +1,154 @@
+// Package spegel exposes Spegel's registry, router, state tracker, and
+// self-bootstrap webhook as embeddable components. It is the library that
+// the spegel CLI (see main.go) wraps; a host program that already owns its
+// own containerd client, leader election, and process lifecycle can depend
+// on this package directly instead of forking the CLI.
+package spegel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+
+	"github.com/go-logr/logr"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/xenitab/spegel/internal/oci"
+	"github.com/xenitab/spegel/internal/routing"
+)
+
+// Component is a unit of work with an explicit start/stop lifecycle and no
+// coupling to process concerns such as flag parsing or os.Exit. NewRouter,
+// NewState, NewRegistry, and NewWebhook each return one.
+type Component interface {
+	// Start runs the component until ctx is cancelled. It returns nil on a
+	// graceful stop.
+	Start(ctx context.Context) error
+	// Shutdown stops the component and releases its resources. It does not
+	// by itself make Start return for every component: the router and
+	// state components return from Start only once ctx is cancelled.
+	Shutdown(ctx context.Context) error
+}
+
+// Options configures an embedded Spegel instance. OCIClient is required,
+// and so is BootstrapSource unless Router is set; Router is constructed with
+// NewRouter when unset.
+type Options struct {
+	Log logr.Logger
+
+	// OCIClient is the backend Spegel mirrors content from. Required.
+	OCIClient oci.OCIClient
+	// Router resolves which peer holds a given image reference. When nil,
+	// New constructs one with NewRouter using RouterAddr and BootstrapSource.
+	Router routing.Router
+
+	// RouterAddr is the address the P2P router listens on. Ignored if
+	// Router is already set.
+	RouterAddr string
+	// BootstrapSource supplies the router's initial peer set. Ignored if
+	// Router is already set, required otherwise: NewRouter returns an error
+	// if both are unset. The standalone CLI supplies
+	// routing.NewKubernetesBootstrapper; an embedding host program must
+	// supply its own to join the DHT without a Kubernetes API server.
+	BootstrapSource routing.BootstrapSource
+
+	// RegistryAddr is the address the OCI registry endpoint listens on.
+	RegistryAddr string
+	// Registries is the set of upstream registries Spegel mirrors.
+	Registries []url.URL
+	// ImageFilter is an inclusive image name filter applied by the state
+	// tracker.
+	ImageFilter string
+
+	// SelfBootstrapEnabled starts the self-bootstrap webhook alongside the
+	// registry and router.
+	SelfBootstrapEnabled bool
+	WebhookAddr          string
+	SelfBootstrapAddr    string
+
+	// BlobParallelPieces enables fetching large blobs as parallel pieces
+	// from multiple peers. See registry.Options for the matching fields.
+	BlobParallelPieces    bool
+	BlobParallelThreshold int64
+	PieceSize             int64
+}
+
+// Spegel is an embeddable instance composed of a router, a state tracker, a
+// registry, and optionally a self-bootstrap webhook.
+type Spegel struct {
+	components []Component
+}
+
+// New wires up a Spegel instance from opts without starting anything. Call
+// Start to run it and Shutdown to stop it.
+func New(ctx context.Context, opts Options) (*Spegel, error) {
+	if opts.OCIClient == nil {
+		return nil, fmt.Errorf("spegel: Options.OCIClient is required")
+	}
+
+	s := &Spegel{}
+
+	router := opts.Router
+	if router == nil {
+		r, routerComp, err := NewRouter(ctx, opts)
+		if err != nil {
+			return nil, fmt.Errorf("spegel: could not create router: %w", err)
+		}
+		router = r
+		s.components = append(s.components, routerComp)
+	}
+
+	stateComp, err := NewState(ctx, opts.OCIClient, router, opts)
+	if err != nil {
+		return nil, fmt.Errorf("spegel: could not create state tracker: %w", err)
+	}
+	s.components = append(s.components, stateComp)
+
+	_, registryComp, err := NewRegistry(ctx, opts.OCIClient, router, opts)
+	if err != nil {
+		return nil, fmt.Errorf("spegel: could not create registry: %w", err)
+	}
+	s.components = append(s.components, registryComp)
+
+	if opts.SelfBootstrapEnabled {
+		webhookComp, err := NewWebhook(ctx, router, opts)
+		if err != nil {
+			return nil, fmt.Errorf("spegel: could not create webhook: %w", err)
+		}
+		s.components = append(s.components, webhookComp)
+	}
+
+	return s, nil
+}
+
+// Start runs every component until ctx is cancelled. It returns the first
+// non-nil error from any component. Shutdown alone does not make Start
+// return.
+func (s *Spegel) Start(ctx context.Context) error {
+	g, ctx := errgroup.WithContext(ctx)
+	for _, c := range s.components {
+		c := c
+		g.Go(func() error {
+			return c.Start(ctx)
+		})
+	}
+	return g.Wait()
+}
+
+// Shutdown stops every component, collecting and returning any errors.
+func (s *Spegel) Shutdown(ctx context.Context) error {
+	errs := make([]error, len(s.components))
+	var wg sync.WaitGroup
+	for i, c := range s.components {
+		i, c := i, c
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = c.Shutdown(ctx)
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
@@ -0,0 +1,41 @@
+package spegel
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"github.com/xenitab/spegel/internal/oci"
+	"github.com/xenitab/spegel/internal/routing"
+	"github.com/xenitab/spegel/internal/state"
+)
+
+type stateComponent struct {
+	ociClient   oci.OCIClient
+	router      routing.Router
+	registries  []url.URL
+	imageFilter string
+}
+
+// NewState creates the component that tracks images in ociClient and
+// advertises them on router.
+func NewState(ctx context.Context, ociClient oci.OCIClient, router routing.Router, opts Options) (Component, error) {
+	return &stateComponent{
+		ociClient:   ociClient,
+		router:      router,
+		registries:  opts.Registries,
+		imageFilter: opts.ImageFilter,
+	}, nil
+}
+
+func (s *stateComponent) Start(ctx context.Context) error {
+	events, err := s.ociClient.Subscribe(ctx)
+	if err != nil {
+		return fmt.Errorf("could not subscribe to %s image events: %w", s.ociClient.Name(), err)
+	}
+	return state.Track(ctx, events, s.router, s.registries, s.imageFilter)
+}
+
+func (s *stateComponent) Shutdown(ctx context.Context) error {
+	return nil
+}
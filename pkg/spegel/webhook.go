@@ -0,0 +1,30 @@
+package spegel
+
+import (
+	"context"
+
+	"github.com/xenitab/spegel/internal/routing"
+	"github.com/xenitab/spegel/internal/webhook"
+)
+
+type webhookComponent struct {
+	webhook *webhook.Webhook
+}
+
+// NewWebhook creates the self-bootstrap webhook component used by nodes to
+// advertise themselves as a bootstrap peer on startup.
+func NewWebhook(ctx context.Context, router routing.Router, opts Options) (Component, error) {
+	wbk, err := webhook.NewWebhook(ctx, opts.WebhookAddr, opts.SelfBootstrapAddr, router)
+	if err != nil {
+		return nil, err
+	}
+	return &webhookComponent{webhook: wbk}, nil
+}
+
+func (w *webhookComponent) Start(ctx context.Context) error {
+	return w.webhook.ListenAndServe(ctx)
+}
+
+func (w *webhookComponent) Shutdown(ctx context.Context) error {
+	return w.webhook.Shutdown()
+}